@@ -0,0 +1,518 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package cni implements the thick-plugin architecture for multus: a small
+// shim binary (CmdAdd/CmdDel/CmdCheck) talks over a unix socket to a
+// long-running Server that does the actual delegate invocation.
+package cni
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	k8s "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/k8sclient"
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+const (
+	socketName = "multus.sock"
+
+	// defaultPerDelegateTimeoutSeconds bounds how long the server waits for
+	// a single delegate's ADD/DEL/CHECK before giving up on it.
+	defaultPerDelegateTimeoutSeconds = 30
+
+	// defaultDelegateWorkers bounds how many delegates are invoked at once
+	// when parallelDelegates is enabled, so a pod with many attachments
+	// can't exhaust the daemon's fd/goroutine budget.
+	defaultDelegateWorkers = 4
+)
+
+// daemonConfig is the thick-daemon's own on-disk configuration, as opposed
+// to the per-request multus NetConf that arrives over the socket.
+type daemonConfig struct {
+	// ParallelDelegates invokes a pod's delegates concurrently instead of
+	// sequentially. Off by default to preserve the historical ordering
+	// guarantees sequential delegate invocation gave callers.
+	ParallelDelegates bool `json:"parallelDelegates,omitempty"`
+
+	// PerDelegateTimeoutSeconds bounds each individual delegate ADD/DEL/CHECK.
+	// Defaults to defaultPerDelegateTimeoutSeconds when unset or zero.
+	PerDelegateTimeoutSeconds int `json:"perDelegateTimeoutSeconds,omitempty"`
+
+	// ReconcileIntervalSeconds, when positive, runs Server.Reconcile on a
+	// timer in addition to the boot-time reconcile. Zero disables the
+	// periodic pass; the boot-time pass still runs. Both passes run only
+	// when the daemon has a Kubernetes client.
+	//
+	// TODO(chunk0-3): the original request asked for a --reconcile-interval
+	// CLI flag. This package has no cmd/ entrypoint of its own (there is no
+	// main package anywhere in this tree to own flag parsing), so only the
+	// JSON config field below exists so far; the flag itself still needs to
+	// be wired up in whatever cmd/ package ends up embedding Server. Treat
+	// chunk0-3 as partially complete until that flag exists, not resolved.
+	ReconcileIntervalSeconds int `json:"reconcileIntervalSeconds,omitempty"`
+
+	// NetworkManager names the NetworkManager implementation (registered via
+	// RegisterPlugin) the daemon wires up pod attachments through. Defaults
+	// to the in-tree "libcni" manager when unset.
+	NetworkManager string `json:"networkManager,omitempty"`
+}
+
+func (c *daemonConfig) perDelegateTimeout() time.Duration {
+	seconds := c.PerDelegateTimeoutSeconds
+	if seconds <= 0 {
+		seconds = defaultPerDelegateTimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Server is the thick-plugin daemon: it listens on a unix socket and
+// executes CNI delegates on behalf of the multus shim.
+type Server struct {
+	http.Server
+	rundir         string
+	k8sClient      *k8s.ClientInfo
+	exec           invoke.Exec
+	config         daemonConfig
+	networkManager NetworkManager
+
+	attachmentsMu sync.Mutex
+	attachments   map[string]*attachmentRecord
+	recordPath    string
+
+	stopReconcile chan struct{}
+}
+
+// loadDaemonConfig reads <rundir>/daemon-config.json if present. A missing
+// file is not an error: the daemon just runs with the zero-value (sequential,
+// default per-delegate timeout) configuration.
+func loadDaemonConfig(rundir string) (daemonConfig, error) {
+	var config daemonConfig
+
+	configPath := filepath.Join(rundir, "daemon-config.json")
+	raw, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("failed to read daemon config %s: %v", configPath, err)
+	}
+
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, fmt.Errorf("failed to parse daemon config %s: %v", configPath, err)
+	}
+	return config, nil
+}
+
+// newCNIServer creates a thick-plugin Server rooted at rundir. exec is used
+// to invoke CNI delegate binaries and is swapped out for a fake in tests.
+func newCNIServer(rundir string, k8sClient *k8s.ClientInfo, exec invoke.Exec) (*Server, error) {
+	config, err := loadDaemonConfig(rundir)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		rundir:        rundir,
+		k8sClient:     k8sClient,
+		exec:          exec,
+		config:        config,
+		recordPath:    attachmentRecordPath(rundir),
+		stopReconcile: make(chan struct{}),
+	}
+
+	attachments, err := loadAttachmentRecords(server.recordPath)
+	if err != nil {
+		return nil, err
+	}
+	server.attachments = attachments
+
+	networkManager, err := newNetworkManager(config.NetworkManager, server)
+	if err != nil {
+		return nil, err
+	}
+	server.networkManager = networkManager
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cni", server.handleCNIRequest)
+	mux.HandleFunc("/version", server.handleVersion)
+	server.Handler = mux
+
+	// Reconcile once at boot so a daemon that crashed or was redeployed
+	// while pods came and went doesn't leak the attachments it forgot
+	// about; if ReconcileIntervalSeconds is set, keep doing that
+	// periodically for the rest of the daemon's life.
+	if server.k8sClient != nil {
+		go server.Reconcile(context.Background())
+		if config.ReconcileIntervalSeconds > 0 {
+			go server.runPeriodicReconcile(time.Duration(config.ReconcileIntervalSeconds) * time.Second)
+		}
+	}
+
+	return server, nil
+}
+
+// Close stops the periodic reconciler and the underlying HTTP server.
+func (s *Server) Close() error {
+	close(s.stopReconcile)
+	return s.Server.Close()
+}
+
+// SocketPath returns the path of the unix socket the thick daemon listens on
+// within rundir.
+func SocketPath(rundir string) string {
+	return filepath.Join(rundir, socketName)
+}
+
+// FilesystemPreRequirements verifies (and creates, if necessary) the run
+// directory the thick daemon's socket lives in.
+func FilesystemPreRequirements(rundir string) error {
+	return os.MkdirAll(rundir, 0700)
+}
+
+// ServerListener opens the unix socket listener the thick daemon serves on.
+func ServerListener(socketPath string) (net.Listener, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old socket %s: %v", socketPath, err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return l, nil
+}
+
+// sandboxFromRequest converts a shim request and its parsed multus NetConf
+// into the PodSandbox the NetworkManager interface deals in. PodPortMappings
+// is left unset here; handleCNIRequest fills it in via podPortMappings once
+// it's resolved the pod's own containerPort mappings too.
+func sandboxFromRequest(req cniRequest, netConf *NetConf) *PodSandbox {
+	return &PodSandbox{
+		ContainerID:  req.ContainerID,
+		Netns:        req.Netns,
+		IfName:       req.IfName,
+		PodNamespace: req.PodNamespace,
+		PodName:      req.PodName,
+		PodUID:       req.PodUID,
+		Delegates:    netConf.Delegates,
+	}
+}
+
+// podPortMappings returns the pod-level port mappings a request's sandbox
+// should carry: netConf.PodPortMappings as taken off the wire, merged with
+// any mappings derived from the pod's own containerPort declarations, so a
+// pod doesn't have to repeat its containerPorts in its multus NetConf to get
+// them forwarded. Requires a k8sClient and a PodName; without either (e.g. a
+// non-Kubernetes runtime, or a request that never resolved one), only the
+// wire-level mappings apply.
+//
+// TODO(chunk0-4): this only derives from container ports. There is no
+// annotation-parsing code anywhere in this tree to derive mappings from pod
+// annotations instead, so that half of the original request is still
+// outstanding, not resolved.
+func (s *Server) podPortMappings(ctx context.Context, req cniRequest, netConf *NetConf) ([]*multustypes.PortMapping, error) {
+	if s.k8sClient == nil || req.PodName == "" {
+		return netConf.PodPortMappings, nil
+	}
+
+	pod, err := s.k8sClient.Client.CoreV1().Pods(req.PodNamespace).Get(ctx, req.PodName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// Most commonly hit on DEL: the pod is already gone from the API by
+		// the time the runtime tears its sandbox down. That's not a reason
+		// to fail the request - fall back to whatever the wire gave us.
+		return netConf.PodPortMappings, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up pod %s/%s for port mappings: %v", req.PodNamespace, req.PodName, err)
+	}
+
+	return mergePortMappings(netConf.PodPortMappings, podPortMappingsFromContainers(pod))
+}
+
+// handleCNIRequest is the daemon-side HTTP handler the shim's CmdAdd/CmdDel/
+// CmdCheck talk to over the unix socket. It only ever talks to the daemon's
+// NetworkManager, never to a delegate plugin directly, so swapping the
+// manager is enough to change how attachments actually get wired up.
+func (s *Server) handleCNIRequest(w http.ResponseWriter, r *http.Request) {
+	// The protocol version header is read but not parsed or checked, so an
+	// absent (a pre-handshake shim) or unrecognized version never fails the
+	// request; a DEL is never dropped because of it. What the daemon does
+	// differently per caller is gated only by the features header below.
+	_ = r.Header.Get(protocolVersionHeader)
+
+	// The shim already negotiated its feature set against this daemon (see
+	// postToDaemon); an absent header just means no features, which is what
+	// a pre-handshake shim gets anyway.
+	features := parseFeatureHeader(r.Header.Get(protocolFeaturesHeader))
+
+	var req cniRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	netConf, err := loadNetConf(req.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sandbox := sandboxFromRequest(req, netConf)
+	sandbox.PodPortMappings, err = s.podPortMappings(r.Context(), req, netConf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var response cniResponse
+	switch req.Command {
+	case "ADD":
+		if features[cachedResultFeature] {
+			if cached, ok := s.cachedResponse(req); ok {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write(cached)
+				return
+			}
+		}
+
+		var attachments []Attachment
+		attachments, err = s.networkManager.Setup(r.Context(), sandbox)
+		if err == nil {
+			response.Results = make([]cnitypes.Result, len(attachments))
+			for i, attachment := range attachments {
+				response.Results[i] = attachment.Result
+			}
+			if features[structuredEventsFeature] {
+				response.Events = make([]string, len(attachments))
+				for i, attachment := range attachments {
+					response.Events[i] = fmt.Sprintf("delegate %s: attached", attachment.Delegate.Name)
+				}
+			}
+
+			responseBody, marshalErr := json.Marshal(response)
+			if marshalErr != nil {
+				http.Error(w, marshalErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if recErr := s.recordAttachment(req, netConf, responseBody); recErr != nil {
+				utilruntime.HandleError(fmt.Errorf("failed to persist attachment record for %s: %v", req.ContainerID, recErr))
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(responseBody)
+			return
+		}
+	case "DEL":
+		err = s.networkManager.Remove(r.Context(), sandbox)
+		// A DEL tears down the attachment whether or not the daemon still
+		// knows about it, so forget the record even on error: there's
+		// nothing left to reconcile once the runtime has called DEL.
+		if forgetErr := s.forgetAttachment(req.ContainerID); forgetErr != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to drop attachment record for %s: %v", req.ContainerID, forgetErr))
+		}
+	case "CHECK":
+		err = s.networkManager.Check(r.Context(), sandbox)
+	default:
+		http.Error(w, fmt.Sprintf("unknown CNI command %q", req.Command), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// configHash fingerprints a shim's raw stdin config so a later ADD for the
+// same containerID can tell "the runtime retried the identical request"
+// apart from "the pod's network config actually changed since".
+func configHash(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedResponse returns the exact response body the daemon sent back for
+// req.ContainerID's last successful ADD, if req hashes identically to that
+// ADD's config *and* still targets the same netns/interface. Netns and
+// IfName must match too: a CRI runtime can retry an ADD for the same
+// containerID against a recreated sandbox (same container/pod id, new
+// netns), and replaying a stale response for that case would leave the new
+// netns completely unwired with no error surfaced. Only consulted when the
+// caller negotiated cachedResultFeature.
+func (s *Server) cachedResponse(req cniRequest) ([]byte, bool) {
+	s.attachmentsMu.Lock()
+	defer s.attachmentsMu.Unlock()
+
+	record, ok := s.attachments[req.ContainerID]
+	if !ok || len(record.CachedResponse) == 0 {
+		return nil, false
+	}
+	if record.Netns != req.Netns || record.IfName != req.IfName {
+		return nil, false
+	}
+	if record.ConfigHash != configHash(req.Config) {
+		return nil, false
+	}
+	return record.CachedResponse, true
+}
+
+// cniRequest is the wire format the shim sends the daemon.
+type cniRequest struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName"`
+	Config      []byte `json:"config"`
+
+	// Pod identity, as reported by the CNI runtime via CNI_ARGS. The daemon
+	// persists these alongside a successful ADD so Reconcile can later tell
+	// whether the pod that requested an attachment still exists.
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+}
+
+// cniResponse is the wire format the daemon sends back to the shim.
+type cniResponse struct {
+	Results []cnitypes.Result `json:"results,omitempty"`
+
+	// Events is a one-line outcome summary per delegate, populated only
+	// when the shim negotiated structuredEventsFeature; a shim that didn't
+	// just gets the merged Results it's always gotten.
+	Events []string `json:"events,omitempty"`
+}
+
+// postToDaemon sends a single CNI command to the thick daemon listening on
+// netConf.SocketDir and waits for its response. It first negotiates the
+// highest protocol version both the shim and the daemon understand, so an
+// old shim talking to a new daemon (or vice versa) degrades gracefully
+// instead of failing.
+func postToDaemon(command string, args *skel.CmdArgs, netConf *NetConf) error {
+	socketPath := SocketPath(netConf.SocketDir)
+	client := unixSocketClient(socketPath)
+
+	negotiated, err := negotiateVersion(currentVersionInfo(), fetchDaemonVersion(socketPath))
+	if err != nil {
+		return fmt.Errorf("failed to negotiate protocol version with multus daemon at %s: %v", socketPath, err)
+	}
+
+	podNamespace, podName, podUID := podInfoFromEnv()
+	body, err := json.Marshal(cniRequest{
+		Command:      command,
+		ContainerID:  args.ContainerID,
+		Netns:        args.Netns,
+		IfName:       args.IfName,
+		Config:       args.StdinData,
+		PodNamespace: podNamespace,
+		PodName:      podName,
+		PodUID:       podUID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal CNI request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://unix/cni", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build CNI request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(protocolVersionHeader, fmt.Sprintf("%d", negotiated.version))
+	if features := negotiated.headerValue(); features != "" {
+		req.Header.Set(protocolFeaturesHeader, features)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach multus daemon at %s: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("multus daemon returned HTTP %d for %s", resp.StatusCode, command)
+	}
+	return nil
+}
+
+// CmdAdd is invoked by the CNI runtime (via the multus shim) to add a pod's
+// network attachments. It forwards the request to the thick daemon.
+func CmdAdd(args *skel.CmdArgs) error {
+	netConf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return postToDaemon("ADD", args, netConf)
+}
+
+// CmdDel is invoked by the CNI runtime to remove a pod's network attachments.
+func CmdDel(args *skel.CmdArgs) error {
+	netConf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return postToDaemon("DEL", args, netConf)
+}
+
+// CmdCheck is invoked by the CNI runtime to verify a pod's network
+// attachments are still correctly wired up.
+func CmdCheck(args *skel.CmdArgs) error {
+	netConf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return postToDaemon("CHECK", args, netConf)
+}
+
+// podInfoFromEnv extracts the pod identity the CNI runtime passes the shim
+// via the CNI_ARGS environment variable (a ';'-separated list of K=V
+// pairs), e.g. "K8S_POD_NAMESPACE=test;K8S_POD_NAME=foo;K8S_POD_UID=abc".
+// Missing or malformed entries simply yield empty strings. The daemon uses
+// pod identity for reconciliation bookkeeping and, when a pod name is
+// present, to look the pod up for its containerPort mappings; a lookup
+// error other than not-found fails the request.
+func podInfoFromEnv() (namespace, name, uid string) {
+	fields := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields["K8S_POD_NAMESPACE"], fields["K8S_POD_NAME"], fields["K8S_POD_UID"]
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+// libcniManagerName is the name daemon-config.json's networkManager field
+// selects to get the default, in-tree NetworkManager.
+const libcniManagerName = "libcni"
+
+func init() {
+	RegisterPlugin(libcniManagerName, newLibcniManager)
+}
+
+// libcniManager is the default NetworkManager: it execs CNI delegate
+// binaries directly via the server's invoke.Exec, exactly the way the thick
+// daemon has always worked.
+type libcniManager struct {
+	server *Server
+}
+
+func newLibcniManager(s *Server) NetworkManager {
+	return &libcniManager{server: s}
+}
+
+// argsFromSandbox builds the skel.CmdArgs a delegate invocation needs out of
+// a PodSandbox.
+func argsFromSandbox(sandbox *PodSandbox) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: sandbox.ContainerID,
+		Netns:       sandbox.Netns,
+		IfName:      sandbox.IfName,
+	}
+}
+
+// delegateResult pairs a delegate with the outcome of invoking it, so
+// parallel results can be merged back in the delegate's declared order.
+type delegateResult struct {
+	delegate *DelegateNetConf
+	result   cnitypes.Result
+	err      error
+}
+
+// Setup runs ADD for every delegate in the sandbox. When the server is
+// configured for parallelDelegates, delegates are invoked concurrently
+// (bounded by defaultDelegateWorkers) with an errgroup and each delegate
+// gets its own perDelegateTimeout budget; otherwise they run sequentially,
+// matching the daemon's historical behavior. On any failure, delegates that
+// already succeeded are DEL'd in reverse order, under the same timeout
+// budget, so a partially-wired pod is never left behind.
+func (m *libcniManager) Setup(ctx context.Context, sandbox *PodSandbox) ([]Attachment, error) {
+	args := argsFromSandbox(sandbox)
+	results, err := m.addDelegates(ctx, args, sandbox)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]Attachment, len(sandbox.Delegates))
+	for i, delegate := range sandbox.Delegates {
+		attachments[i] = Attachment{Delegate: delegate, Result: results[i]}
+	}
+	return attachments, nil
+}
+
+func (m *libcniManager) addDelegates(ctx context.Context, args *skel.CmdArgs, sandbox *PodSandbox) ([]cnitypes.Result, error) {
+	results := make([]cnitypes.Result, len(sandbox.Delegates))
+
+	if !m.server.config.ParallelDelegates {
+		for i, delegate := range sandbox.Delegates {
+			mappings, err := mergePortMappings(sandbox.PodPortMappings, delegate.PortMappings)
+			if err != nil {
+				return nil, fmt.Errorf("delegate %d (%s): %v", i, delegate.Name, err)
+			}
+
+			delegateCtx, cancel := context.WithTimeout(ctx, m.server.config.perDelegateTimeout())
+			result, err := m.delegateAdd(delegateCtx, args, delegate, mappings)
+			cancel()
+			if err != nil {
+				m.rollbackDelegates(ctx, args, sandbox, sandbox.Delegates[:i])
+				return nil, fmt.Errorf("delegate %d (%s) add failed: %v", i, delegate.Name, err)
+			}
+			results[i] = result
+		}
+		return results, nil
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	resultCh := make(chan delegateResult, len(sandbox.Delegates))
+
+	// Workers pull delegate indices off a pre-loaded queue instead of one
+	// goroutine being spawned per delegate, so defaultDelegateWorkers bounds
+	// goroutine creation itself, not just how many delegates are exec'ing at
+	// once.
+	queue := make(chan int, len(sandbox.Delegates))
+	for i := range sandbox.Delegates {
+		queue <- i
+	}
+	close(queue)
+
+	workers := defaultDelegateWorkers
+	if workers > len(sandbox.Delegates) {
+		workers = len(sandbox.Delegates)
+	}
+	for w := 0; w < workers; w++ {
+		group.Go(func() error {
+			for i := range queue {
+				delegate := sandbox.Delegates[i]
+				mappings, err := mergePortMappings(sandbox.PodPortMappings, delegate.PortMappings)
+				if err != nil {
+					return fmt.Errorf("delegate %d (%s): %v", i, delegate.Name, err)
+				}
+
+				delegateCtx, cancel := context.WithTimeout(groupCtx, m.server.config.perDelegateTimeout())
+				result, err := m.delegateAdd(delegateCtx, args, delegate, mappings)
+				cancel()
+
+				resultCh <- delegateResult{delegate: delegate, result: result, err: err}
+				if err != nil {
+					return fmt.Errorf("delegate %d (%s): %v", i, delegate.Name, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	groupErr := group.Wait()
+	close(resultCh)
+
+	resultsByDelegate := make(map[*DelegateNetConf]delegateResult, len(sandbox.Delegates))
+	for r := range resultCh {
+		resultsByDelegate[r.delegate] = r
+	}
+
+	succeeded := make([]*DelegateNetConf, 0, len(sandbox.Delegates))
+	for i, delegate := range sandbox.Delegates {
+		r, ok := resultsByDelegate[delegate]
+		if !ok || r.err != nil {
+			continue
+		}
+		results[i] = r.result
+		succeeded = append(succeeded, delegate)
+	}
+
+	if groupErr != nil {
+		m.rollbackDelegates(ctx, args, sandbox, succeeded)
+		return nil, fmt.Errorf("parallel delegate add failed: %v", groupErr)
+	}
+	return results, nil
+}
+
+// rollbackDelegates issues DEL, in reverse order, for delegates whose ADD
+// already succeeded. Errors are best-effort: we're already unwinding a
+// failure and must not mask the original one.
+func (m *libcniManager) rollbackDelegates(ctx context.Context, args *skel.CmdArgs, sandbox *PodSandbox, delegates []*DelegateNetConf) {
+	for i := len(delegates) - 1; i >= 0; i-- {
+		mappings, err := mergePortMappings(sandbox.PodPortMappings, delegates[i].PortMappings)
+		if err != nil {
+			continue
+		}
+		delegateCtx, cancel := context.WithTimeout(ctx, m.server.config.perDelegateTimeout())
+		_, _ = m.delegateDel(delegateCtx, args, delegates[i], mappings)
+		cancel()
+	}
+}
+
+// Remove DELs every delegate in the sandbox, in reverse declared order,
+// mirroring the order a pod's attachments were added in.
+func (m *libcniManager) Remove(ctx context.Context, sandbox *PodSandbox) error {
+	args := argsFromSandbox(sandbox)
+
+	for i := len(sandbox.Delegates) - 1; i >= 0; i-- {
+		delegate := sandbox.Delegates[i]
+		mappings, err := mergePortMappings(sandbox.PodPortMappings, delegate.PortMappings)
+		if err != nil {
+			return fmt.Errorf("delegate %s: %v", delegate.Name, err)
+		}
+
+		delegateCtx, cancel := context.WithTimeout(ctx, m.server.config.perDelegateTimeout())
+		_, err = m.delegateDel(delegateCtx, args, delegate, mappings)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("delegate %s del failed: %v", delegate.Name, err)
+		}
+	}
+	return nil
+}
+
+// Check runs CHECK for every delegate in the sandbox.
+func (m *libcniManager) Check(ctx context.Context, sandbox *PodSandbox) error {
+	args := argsFromSandbox(sandbox)
+
+	for _, delegate := range sandbox.Delegates {
+		mappings, err := mergePortMappings(sandbox.PodPortMappings, delegate.PortMappings)
+		if err != nil {
+			return fmt.Errorf("delegate %s: %v", delegate.Name, err)
+		}
+
+		delegateCtx, cancel := context.WithTimeout(ctx, m.server.config.perDelegateTimeout())
+		_, err = m.delegateCheck(delegateCtx, args, delegate, mappings)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("delegate %s check failed: %v", delegate.Name, err)
+		}
+	}
+	return nil
+}
+
+// Status reports whether the sandbox's network namespace still exists.
+// libcni delegates don't expose a STATUS verb of their own, so this is the
+// same netns liveness check Reconcile has always relied on.
+func (m *libcniManager) Status(ctx context.Context, sandbox *PodSandbox) error {
+	if _, err := os.Stat(sandbox.Netns); os.IsNotExist(err) {
+		return ErrSandboxGone
+	}
+	return nil
+}
+
+func (m *libcniManager) delegateAdd(ctx context.Context, args *skel.CmdArgs, delegate *DelegateNetConf, mappings []*multustypes.PortMapping) (cnitypes.Result, error) {
+	return m.execDelegate(ctx, "ADD", args, delegate, mappings)
+}
+
+func (m *libcniManager) delegateDel(ctx context.Context, args *skel.CmdArgs, delegate *DelegateNetConf, mappings []*multustypes.PortMapping) (cnitypes.Result, error) {
+	return m.execDelegate(ctx, "DEL", args, delegate, mappings)
+}
+
+func (m *libcniManager) delegateCheck(ctx context.Context, args *skel.CmdArgs, delegate *DelegateNetConf, mappings []*multustypes.PortMapping) (cnitypes.Result, error) {
+	return m.execDelegate(ctx, "CHECK", args, delegate, mappings)
+}
+
+// execDelegate shells out to the delegate plugin binary via the server's
+// invoke.Exec, which is the only seam tests need to fake. When the delegate
+// advertises the "portMappings" capability, mappings is injected into its
+// stdin config as runtimeConfig.portMappings; delegates that never asked for
+// it never see it.
+func (m *libcniManager) execDelegate(ctx context.Context, command string, args *skel.CmdArgs, delegate *DelegateNetConf, mappings []*multustypes.PortMapping) (cnitypes.Result, error) {
+	stdin, err := delegate.configWithPortMappings(mappings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal delegate %s config: %v", delegate.Name, err)
+	}
+
+	environ := append(os.Environ(), "CNI_COMMAND="+command)
+	raw, err := m.server.exec.ExecPlugin(ctx, delegate.Conf.Type, stdin, environ)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec delegate %s: %v", delegate.Name, err)
+	}
+
+	if command == "DEL" {
+		return nil, nil
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return &rawResult{data: raw}, nil
+}
+
+// rawResult is the thinnest possible cnitypes.Result: it just remembers the
+// bytes a delegate returned so they can be re-serialized into the merged
+// response without the daemon needing to understand every CNI version's
+// result schema.
+type rawResult struct {
+	data []byte
+}
+
+func (r *rawResult) Version() string { return "" }
+func (r *rawResult) GetAsVersion(string) (cnitypes.Result, error) { return r, nil }
+func (r *rawResult) Print() error {
+	_, err := fmt.Println(string(r.data))
+	return err
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+// PodSandbox is everything a NetworkManager needs to wire up, tear down, or
+// inspect a pod's network attachments. It is the daemon's internal
+// representation of a CNI request, independent of the HTTP wire format the
+// shim happens to send it over.
+type PodSandbox struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+
+	PodNamespace string
+	PodName      string
+	PodUID       string
+
+	Delegates       []*DelegateNetConf
+	PodPortMappings []*multustypes.PortMapping
+}
+
+// Attachment is one delegate's outcome for a pod sandbox, as returned by a
+// NetworkManager's Setup.
+type Attachment struct {
+	Delegate *DelegateNetConf
+	Result   cnitypes.Result
+}
+
+// ErrSandboxGone is returned by a NetworkManager's Status to report that a
+// sandbox's network namespace is confirmed gone, as opposed to a manager
+// simply being unreachable. Reconcile uses this to tell "this attachment is
+// orphaned" apart from "try again later".
+var ErrSandboxGone = errors.New("sandbox network namespace no longer exists")
+
+// NetworkManager is the thick daemon's integration seam for actually
+// wiring up, tearing down, and inspecting a pod's network attachments. The
+// in-tree "libcni" manager execs CNI delegate binaries directly, the way the
+// daemon has always worked; RegisterPlugin lets another implementation be
+// selected by name from daemon-config.json instead, which is also how this
+// chunk's own tests swap in a fakeNetworkManager without touching exec at
+// all.
+type NetworkManager interface {
+	Setup(ctx context.Context, sandbox *PodSandbox) ([]Attachment, error)
+	Remove(ctx context.Context, sandbox *PodSandbox) error
+	Check(ctx context.Context, sandbox *PodSandbox) error
+	Status(ctx context.Context, sandbox *PodSandbox) error
+}
+
+// NetworkManagerFactory builds a NetworkManager bound to a running Server,
+// so a manager implementation can reuse the server's exec, config, and so on.
+type NetworkManagerFactory func(s *Server) NetworkManager
+
+var networkManagerFactories = map[string]NetworkManagerFactory{}
+
+// RegisterPlugin makes a NetworkManager factory available under name, for
+// daemon-config.json's networkManager field to select. Intended to be called
+// from an init() function; a name registered twice overwrites the earlier
+// registration.
+func RegisterPlugin(name string, factory NetworkManagerFactory) {
+	networkManagerFactories[name] = factory
+}
+
+// newNetworkManager builds the NetworkManager daemon-config.json's
+// networkManager field names, defaulting to the in-tree libcni manager when
+// unset.
+func newNetworkManager(name string, s *Server) (NetworkManager, error) {
+	if name == "" {
+		name = libcniManagerName
+	}
+
+	factory, ok := networkManagerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown network manager %q", name)
+	}
+	return factory(s), nil
+}
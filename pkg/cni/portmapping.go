@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+const portMappingsCapability = "portMappings"
+
+// portMappingKey identifies a single host-facing port mapping for
+// deduplication and overlap detection, independent of which container port
+// it forwards to.
+type portMappingKey struct {
+	hostIP   string
+	protocol string
+	port     int
+}
+
+func normalizedProtocol(protocol string) string {
+	if protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(protocol)
+}
+
+func keyOf(pm *multustypes.PortMapping) portMappingKey {
+	return portMappingKey{hostIP: pm.HostIP, protocol: normalizedProtocol(pm.Protocol), port: pm.HostPort}
+}
+
+func rangeEnd(pm *multustypes.PortMapping) int {
+	if pm.HostPortEnd == 0 {
+		return pm.HostPort
+	}
+	return pm.HostPortEnd
+}
+
+func equalMappings(a, b *multustypes.PortMapping) bool {
+	return a.HostIP == b.HostIP &&
+		normalizedProtocol(a.Protocol) == normalizedProtocol(b.Protocol) &&
+		a.HostPort == b.HostPort &&
+		a.HostPortEnd == b.HostPortEnd &&
+		a.ContainerPort == b.ContainerPort
+}
+
+func mappingsOverlap(a, b *multustypes.PortMapping) bool {
+	if a.HostIP != b.HostIP || normalizedProtocol(a.Protocol) != normalizedProtocol(b.Protocol) {
+		return false
+	}
+	return a.HostPort <= rangeEnd(b) && b.HostPort <= rangeEnd(a)
+}
+
+// mergePortMappings combines a pod's port mappings with one delegate's own,
+// deduplicating exact (HostIP, HostPort, Protocol) repeats and rejecting
+// overlapping host port ranges with a clear error, since the kernel would
+// otherwise reject (or silently shadow) one of them at bind time anyway.
+func mergePortMappings(sets ...[]*multustypes.PortMapping) ([]*multustypes.PortMapping, error) {
+	seen := map[portMappingKey]*multustypes.PortMapping{}
+	merged := make([]*multustypes.PortMapping, 0)
+
+	for _, set := range sets {
+		for _, mapping := range set {
+			if existing, ok := seen[keyOf(mapping)]; ok {
+				if equalMappings(existing, mapping) {
+					continue
+				}
+				return nil, fmt.Errorf("conflicting port mappings for host %s:%d/%s",
+					mapping.HostIP, mapping.HostPort, normalizedProtocol(mapping.Protocol))
+			}
+
+			for _, other := range merged {
+				if mappingsOverlap(mapping, other) && !equalMappings(mapping, other) {
+					return nil, fmt.Errorf(
+						"port mapping %s:%d-%d/%s overlaps existing mapping %s:%d-%d/%s",
+						mapping.HostIP, mapping.HostPort, rangeEnd(mapping), normalizedProtocol(mapping.Protocol),
+						other.HostIP, other.HostPort, rangeEnd(other), normalizedProtocol(other.Protocol))
+				}
+			}
+
+			seen[keyOf(mapping)] = mapping
+			merged = append(merged, mapping)
+		}
+	}
+
+	return merged, nil
+}
+
+// podPortMappingsFromContainers derives pod-level port mappings from a pod's
+// own containerPort declarations: Kubernetes' corev1.ContainerPort is
+// already a host<->container port mapping, so a container port that sets
+// HostPort is treated as one. Container ports that leave HostPort unset
+// aren't host-facing and produce no mapping.
+func podPortMappingsFromContainers(pod *corev1.Pod) []*multustypes.PortMapping {
+	var mappings []*multustypes.PortMapping
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.HostPort == 0 {
+				continue
+			}
+			mappings = append(mappings, &multustypes.PortMapping{
+				HostPort:      int(port.HostPort),
+				ContainerPort: int(port.ContainerPort),
+				Protocol:      string(port.Protocol),
+				HostIP:        port.HostIP,
+			})
+		}
+	}
+	return mappings
+}
+
+// delegateSupportsPortMappings reports whether a delegate advertised the
+// "portMappings" CNI capability in its own plugin config.
+func delegateSupportsPortMappings(delegate *DelegateNetConf) bool {
+	return delegate.Conf.Capabilities[portMappingsCapability]
+}
+
+// configWithPortMappings renders the delegate's stdin config, injecting the
+// merged port mappings as runtimeConfig.portMappings when (and only when)
+// the delegate advertised the capability, so plugins that never asked for
+// port mappings never see them.
+func (d *DelegateNetConf) configWithPortMappings(mappings []*multustypes.PortMapping) ([]byte, error) {
+	if len(mappings) == 0 || !delegateSupportsPortMappings(d) {
+		return json.Marshal(d)
+	}
+
+	merged := map[string]interface{}{}
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal delegate %s conf: %v", d.Name, err)
+	}
+	if err := json.Unmarshal(raw, &merged); err != nil {
+		return nil, fmt.Errorf("failed to marshal delegate %s conf: %v", d.Name, err)
+	}
+
+	runtimeConfig, _ := merged["runtimeConfig"].(map[string]interface{})
+	if runtimeConfig == nil {
+		runtimeConfig = map[string]interface{}{}
+	}
+	runtimeConfig["portMappings"] = mappings
+	merged["runtimeConfig"] = runtimeConfig
+
+	return json.Marshal(merged)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+var _ = Describe("Port mapping merging", func() {
+	It("merges pod-level and per-delegate port mappings", func() {
+		podLevel := []*multustypes.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}
+		perDelegate := []*multustypes.PortMapping{{HostPort: 8443, ContainerPort: 443, Protocol: "tcp"}}
+
+		merged, err := mergePortMappings(podLevel, perDelegate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged).To(ConsistOf(podLevel[0], perDelegate[0]))
+	})
+
+	It("deduplicates an identical mapping declared at both levels", func() {
+		mapping := &multustypes.PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+		duplicate := &multustypes.PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+
+		merged, err := mergePortMappings([]*multustypes.PortMapping{mapping}, []*multustypes.PortMapping{duplicate})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged).To(HaveLen(1))
+	})
+
+	It("rejects two different mappings claiming the same host port", func() {
+		mapping := &multustypes.PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+		conflicting := &multustypes.PortMapping{HostPort: 8080, ContainerPort: 8080, Protocol: "tcp"}
+
+		_, err := mergePortMappings([]*multustypes.PortMapping{mapping}, []*multustypes.PortMapping{conflicting})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects overlapping host port ranges", func() {
+		first := &multustypes.PortMapping{HostPort: 30000, HostPortEnd: 30010, ContainerPort: 80, Protocol: "tcp"}
+		overlapping := &multustypes.PortMapping{HostPort: 30005, HostPortEnd: 30015, ContainerPort: 81, Protocol: "tcp"}
+
+		_, err := mergePortMappings([]*multustypes.PortMapping{first}, []*multustypes.PortMapping{overlapping})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("allows the same host port range on different protocols", func() {
+		tcpRange := &multustypes.PortMapping{HostPort: 30000, HostPortEnd: 30010, ContainerPort: 80, Protocol: "tcp"}
+		udpRange := &multustypes.PortMapping{HostPort: 30000, HostPortEnd: 30010, ContainerPort: 80, Protocol: "udp"}
+
+		merged, err := mergePortMappings([]*multustypes.PortMapping{tcpRange}, []*multustypes.PortMapping{udpRange})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged).To(HaveLen(2))
+	})
+
+	It("only injects runtimeConfig.portMappings into delegates that advertise the capability", func() {
+		mappings := []*multustypes.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}
+
+		withCapability := &DelegateNetConf{Name: "weave1"}
+		Expect(withCapability.UnmarshalJSON([]byte(
+			`{"name":"weave1","cniVersion":"0.3.1","type":"weave-net","capabilities":{"portMappings":true}}`))).To(Succeed())
+
+		withoutCapability := &DelegateNetConf{Name: "weave2"}
+		Expect(withoutCapability.UnmarshalJSON([]byte(
+			`{"name":"weave2","cniVersion":"0.3.1","type":"weave-net"}`))).To(Succeed())
+
+		supportingStdin, err := withCapability.configWithPortMappings(mappings)
+		Expect(err).NotTo(HaveOccurred())
+		var supportingConf map[string]interface{}
+		Expect(json.Unmarshal(supportingStdin, &supportingConf)).To(Succeed())
+		Expect(supportingConf).To(HaveKey("runtimeConfig"))
+
+		nonSupportingStdin, err := withoutCapability.configWithPortMappings(mappings)
+		Expect(err).NotTo(HaveOccurred())
+		var nonSupportingConf map[string]interface{}
+		Expect(json.Unmarshal(nonSupportingStdin, &nonSupportingConf)).To(Succeed())
+		Expect(nonSupportingConf).NotTo(HaveKey("runtimeConfig"))
+	})
+})
@@ -0,0 +1,234 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const attachmentRecordFile = "attachments.json"
+
+// attachmentRecord is everything Reconcile needs to tear an attachment back
+// down without the original ADD request: the identity the delegate DEL call
+// needs, and the pod the attachment belongs to so a vanished pod can be
+// told apart from one that's merely being reconciled for the first time.
+type attachmentRecord struct {
+	ContainerID string             `json:"containerID"`
+	Netns       string             `json:"netns"`
+	IfName      string             `json:"ifName"`
+
+	PodNamespace string `json:"podNamespace"`
+	PodName      string `json:"podName"`
+	PodUID       string `json:"podUID"`
+
+	Delegates []*DelegateNetConf `json:"delegates"`
+
+	// ConfigHash and CachedResponse let a later ADD for this containerID be
+	// answered straight out of this record instead of re-running the
+	// NetworkManager, when the shim negotiates cachedResultFeature and the
+	// request's config hashes identically to the one that produced
+	// CachedResponse.
+	ConfigHash     string `json:"configHash,omitempty"`
+	CachedResponse []byte `json:"cachedResponse,omitempty"`
+}
+
+// attachmentRecordPath is where the daemon persists its in-flight
+// attachments, next to its socket so both live under the same run dir.
+func attachmentRecordPath(rundir string) string {
+	return filepath.Join(rundir, attachmentRecordFile)
+}
+
+func loadAttachmentRecords(path string) (map[string]*attachmentRecord, error) {
+	attachments := map[string]*attachmentRecord{}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return attachments, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read attachment record %s: %v", path, err)
+	}
+
+	var records []*attachmentRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse attachment record %s: %v", path, err)
+	}
+	for _, record := range records {
+		attachments[record.ContainerID] = record
+	}
+	return attachments, nil
+}
+
+// saveAttachmentRecords persists the current attachment set. Called with
+// attachmentsMu already held.
+func (s *Server) saveAttachmentRecords() error {
+	records := make([]*attachmentRecord, 0, len(s.attachments))
+	for _, record := range s.attachments {
+		records = append(records, record)
+	}
+
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment records: %v", err)
+	}
+	if err := os.WriteFile(s.recordPath, raw, 0600); err != nil {
+		return fmt.Errorf("failed to write attachment record %s: %v", s.recordPath, err)
+	}
+	return nil
+}
+
+// recordAttachment persists a successful ADD so Reconcile can find and
+// clean it up even if the daemon restarts before the runtime calls DEL.
+// responseBody is the exact bytes the daemon sent back for this ADD, kept
+// around so a retried ADD with an unchanged config can be replayed under
+// cachedResultFeature without re-running the NetworkManager.
+func (s *Server) recordAttachment(req cniRequest, netConf *NetConf, responseBody []byte) error {
+	s.attachmentsMu.Lock()
+	defer s.attachmentsMu.Unlock()
+
+	s.attachments[req.ContainerID] = &attachmentRecord{
+		ContainerID:    req.ContainerID,
+		Netns:          req.Netns,
+		IfName:         req.IfName,
+		PodNamespace:   req.PodNamespace,
+		PodName:        req.PodName,
+		PodUID:         req.PodUID,
+		Delegates:      netConf.Delegates,
+		ConfigHash:     configHash(req.Config),
+		CachedResponse: responseBody,
+	}
+	return s.saveAttachmentRecords()
+}
+
+// forgetAttachment drops a containerID's record, typically after a
+// successful DEL. Forgetting a containerID that was never recorded is not
+// an error.
+func (s *Server) forgetAttachment(containerID string) error {
+	s.attachmentsMu.Lock()
+	defer s.attachmentsMu.Unlock()
+
+	if _, ok := s.attachments[containerID]; !ok {
+		return nil
+	}
+	delete(s.attachments, containerID)
+	return s.saveAttachmentRecords()
+}
+
+// Reconcile lists every persisted attachment and DELs any whose pod no
+// longer exists (or has a different UID, i.e. was replaced) or whose netns
+// is gone, clearing the matching record once the DEL succeeds. It is run
+// once at daemon boot, since that's the only moment a crashed or
+// redeployed daemon can have forgotten attachments whose pods came and
+// went while it was down, and, if ReconcileIntervalSeconds is configured,
+// again on a timer for the rest of the process's life. newCNIServer starts
+// both only when the daemon has a Kubernetes client.
+func (s *Server) Reconcile(ctx context.Context) {
+	s.attachmentsMu.Lock()
+	candidates := make([]*attachmentRecord, 0, len(s.attachments))
+	for _, record := range s.attachments {
+		candidates = append(candidates, record)
+	}
+	s.attachmentsMu.Unlock()
+
+	for _, record := range candidates {
+		orphaned, err := s.isOrphaned(ctx, record)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("reconcile: failed to check attachment %s: %v", record.ContainerID, err))
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+
+		if err := s.reapAttachment(ctx, record); err != nil {
+			utilruntime.HandleError(fmt.Errorf("reconcile: failed to GC attachment %s: %v", record.ContainerID, err))
+			continue
+		}
+	}
+}
+
+// isOrphaned reports whether record's pod is gone (deleted, or replaced by
+// a pod with a different UID) or its netns no longer exists.
+func (s *Server) isOrphaned(ctx context.Context, record *attachmentRecord) (bool, error) {
+	if errors.Is(s.networkManager.Status(ctx, sandboxFromRecord(record)), ErrSandboxGone) {
+		return true, nil
+	}
+
+	if s.k8sClient == nil || record.PodName == "" {
+		return false, nil
+	}
+
+	pod, err := s.k8sClient.Client.CoreV1().Pods(record.PodNamespace).Get(ctx, record.PodName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if record.PodUID != "" && string(pod.UID) != record.PodUID {
+		return true, nil
+	}
+	return false, nil
+}
+
+// sandboxFromRecord rebuilds the PodSandbox a persisted attachmentRecord
+// describes, so Reconcile can hand it to the NetworkManager the same way a
+// live request would.
+func sandboxFromRecord(record *attachmentRecord) *PodSandbox {
+	return &PodSandbox{
+		ContainerID:  record.ContainerID,
+		Netns:        record.Netns,
+		IfName:       record.IfName,
+		PodNamespace: record.PodNamespace,
+		PodName:      record.PodName,
+		PodUID:       record.PodUID,
+		Delegates:    record.Delegates,
+	}
+}
+
+// reapAttachment removes an orphaned attachment through the daemon's
+// NetworkManager and drops the record once that succeeds.
+func (s *Server) reapAttachment(ctx context.Context, record *attachmentRecord) error {
+	if err := s.networkManager.Remove(ctx, sandboxFromRecord(record)); err != nil {
+		return fmt.Errorf("failed to remove attachment %s: %v", record.ContainerID, err)
+	}
+	return s.forgetAttachment(record.ContainerID)
+}
+
+// runPeriodicReconcile runs Reconcile on a ticker until the server is
+// closed.
+func (s *Server) runPeriodicReconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Reconcile(context.Background())
+		case <-s.stopReconcile:
+			return
+		}
+	}
+}
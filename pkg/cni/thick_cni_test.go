@@ -17,25 +17,34 @@ package cni
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/record"
 
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+
 	netfake "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/fake"
 	k8s "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/k8sclient"
 	testhelpers "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/testing"
@@ -48,10 +57,45 @@ func TestMultusThickCNIArchitecture(t *testing.T) {
 	RunSpecs(t, suiteName)
 }
 
-type fakeExec struct{}
+// fakeExec stands in for the real CNI plugin invocation. delay optionally
+// simulates how long a delegate binary takes to run, so tests can tell
+// parallel delegate invocation apart from sequential. Every invocation's
+// CNI command is recorded so tests can assert a DEL actually happened.
+type fakeExec struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (fe *fakeExec) seenCommands() []string {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return append([]string{}, fe.commands...)
+}
+
+func commandFromEnviron(environ []string) string {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "CNI_COMMAND=") {
+			return strings.TrimPrefix(kv, "CNI_COMMAND=")
+		}
+	}
+	return ""
+}
 
 // ExecPlugin executes the plugin
 func (fe *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	fe.mu.Lock()
+	fe.commands = append(fe.commands, commandFromEnviron(environ))
+	fe.mu.Unlock()
+
+	if fe.delay > 0 {
+		select {
+		case <-time.After(fe.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	return []byte("{}"), nil
 }
 
@@ -65,6 +109,79 @@ func (fe *fakeExec) Decode(jsonBytes []byte) (version.PluginInfo, error) {
 	return nil, nil
 }
 
+// indexedFakeExec returns each delegate's own name as its result, so a
+// parallel Setup's results can be checked against the right delegate by
+// identity rather than by position alone. delegateCount-1-index's worth of
+// baseDelay is applied per delegate, so declared-order delegates complete in
+// the *reverse* of their declared order - the only way a completion-order
+// merge bug (instead of the declared-order merge the daemon promises) would
+// actually be caught.
+type indexedFakeExec struct {
+	baseDelay     time.Duration
+	delegateCount int
+}
+
+func (e *indexedFakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	var conf struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return nil, err
+	}
+
+	var index int
+	if _, err := fmt.Sscanf(conf.Name, "weave%d", &index); err != nil {
+		return nil, fmt.Errorf("unexpected delegate name %q: %v", conf.Name, err)
+	}
+
+	select {
+	case <-time.After(e.baseDelay * time.Duration(e.delegateCount-1-index)):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []byte(fmt.Sprintf(`{"name":%q}`, conf.Name)), nil
+}
+
+func (e *indexedFakeExec) FindInPath(plugin string, paths []string) (string, error) {
+	return "", nil
+}
+
+func (e *indexedFakeExec) Decode(jsonBytes []byte) (version.PluginInfo, error) {
+	return nil, nil
+}
+
+// fakeNetworkManager is a NetworkManager that never touches invoke.Exec at
+// all, proving that NetworkManager (not fakeExec) is the only seam the
+// daemon needs for an alternative backend. It also remembers the last
+// sandbox Setup was called with, so tests can assert on what the daemon
+// actually resolved (e.g. derived PodPortMappings) without a real delegate.
+type fakeNetworkManager struct {
+	lastSandbox *PodSandbox
+}
+
+func newFakeNetworkManager(s *Server) NetworkManager {
+	return &fakeNetworkManager{}
+}
+
+func (m *fakeNetworkManager) Setup(ctx context.Context, sandbox *PodSandbox) ([]Attachment, error) {
+	m.lastSandbox = sandbox
+	attachments := make([]Attachment, len(sandbox.Delegates))
+	for i, delegate := range sandbox.Delegates {
+		attachments[i] = Attachment{Delegate: delegate, Result: &rawResult{data: []byte("{}")}}
+	}
+	return attachments, nil
+}
+
+func (m *fakeNetworkManager) Remove(ctx context.Context, sandbox *PodSandbox) error { return nil }
+
+func (m *fakeNetworkManager) Check(ctx context.Context, sandbox *PodSandbox) error { return nil }
+
+func (m *fakeNetworkManager) Status(ctx context.Context, sandbox *PodSandbox) error { return nil }
+
+func init() {
+	RegisterPlugin("fake", newFakeNetworkManager)
+}
+
 var _ = Describe(suiteName, func() {
 	const thickCNISocketDirPath = "multus-cni-thick-arch-socket-path"
 
@@ -107,6 +224,7 @@ var _ = Describe(suiteName, func() {
 			cniServer *Server
 			K8sClient *k8s.ClientInfo
 			netns     ns.NetNS
+			exec      *fakeExec
 		)
 
 		BeforeEach(func() {
@@ -114,7 +232,13 @@ var _ = Describe(suiteName, func() {
 			K8sClient = fakeK8sClient()
 
 			Expect(FilesystemPreRequirements(thickPluginRunDir)).To(Succeed())
-			cniServer, err = startCNIServer(thickPluginRunDir, K8sClient)
+			// Select the "fake" NetworkManager registered above instead of
+			// the default libcni one, so these tests prove the daemon only
+			// ever talks to attachments through the NetworkManager
+			// interface: exec below should never see a single invocation.
+			Expect(writeManagerDaemonConfig(thickPluginRunDir, "fake")).To(Succeed())
+			exec = &fakeExec{}
+			cniServer, err = startCNIServerWithExec(thickPluginRunDir, K8sClient, exec)
 			Expect(err).NotTo(HaveOccurred())
 
 			netns, err = testutils.NewNS()
@@ -134,14 +258,220 @@ var _ = Describe(suiteName, func() {
 
 		It("ADD works successfully", func() {
 			Expect(CmdAdd(cniCmdArgs(containerID, netns.Path(), ifaceName, referenceConfig(thickPluginRunDir)))).To(Succeed())
+			Expect(exec.seenCommands()).To(BeEmpty())
 		})
 
 		It("DEL works successfully", func() {
 			Expect(CmdDel(cniCmdArgs(containerID, netns.Path(), ifaceName, referenceConfig(thickPluginRunDir)))).To(Succeed())
+			Expect(exec.seenCommands()).To(BeEmpty())
 		})
 
 		It("CHECK works successfully", func() {
 			Expect(CmdCheck(cniCmdArgs(containerID, netns.Path(), ifaceName, referenceConfig(thickPluginRunDir)))).To(Succeed())
+			Expect(exec.seenCommands()).To(BeEmpty())
+		})
+	})
+
+	Context("pod-level port mapping derivation", func() {
+		const (
+			containerID = "port-mapping-pod"
+			ifaceName   = "eth0"
+			podName     = "ported-pod"
+		)
+
+		var (
+			cniServer *Server
+			K8sClient *k8s.ClientInfo
+			netns     ns.NetNS
+		)
+
+		BeforeEach(func() {
+			var err error
+			K8sClient = fakeK8sClient()
+
+			Expect(FilesystemPreRequirements(thickPluginRunDir)).To(Succeed())
+			Expect(writeManagerDaemonConfig(thickPluginRunDir, "fake")).To(Succeed())
+			cniServer, err = startCNIServerWithExec(thickPluginRunDir, K8sClient, &fakeExec{})
+			Expect(err).NotTo(HaveOccurred())
+
+			netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(prepareCNIEnv(netns.Path(), "test", podName, "testUID")).To(Succeed())
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: "test"},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name: "app",
+						Ports: []corev1.ContainerPort{
+							{HostPort: 8080, ContainerPort: 80, Protocol: corev1.ProtocolTCP},
+							// No HostPort: not host-facing, must not produce a mapping.
+							{ContainerPort: 9090},
+						},
+					}},
+				},
+			}
+			_, err = K8sClient.Client.CoreV1().Pods("test").Create(context.TODO(), pod, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(cniServer.Close()).To(Succeed())
+			Expect(teardownCNIEnv()).To(Succeed())
+			Expect(K8sClient.Client.CoreV1().Pods("test").Delete(
+				context.TODO(), podName, metav1.DeleteOptions{}))
+		})
+
+		It("derives a PodPortMapping from the pod's own containerPort HostPort", func() {
+			Expect(CmdAdd(cniCmdArgs(containerID, netns.Path(), ifaceName, referenceConfig(thickPluginRunDir)))).To(Succeed())
+
+			fakeManager, ok := cniServer.networkManager.(*fakeNetworkManager)
+			Expect(ok).To(BeTrue())
+			Expect(fakeManager.lastSandbox).NotTo(BeNil())
+			Expect(fakeManager.lastSandbox.PodPortMappings).To(Equal([]*multustypes.PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "TCP"},
+			}))
+		})
+	})
+
+	Context("parallel delegate invocation", func() {
+		const (
+			containerID      = "987654321"
+			ifaceName        = "eth0"
+			podName          = "my-little-pod"
+			delegateCount    = 4
+			delegateDelay    = 200 * time.Millisecond
+			perDelegateGrace = 2
+		)
+
+		var (
+			cniServer *Server
+			K8sClient *k8s.ClientInfo
+			netns     ns.NetNS
+		)
+
+		BeforeEach(func() {
+			var err error
+			K8sClient = fakeK8sClient()
+
+			Expect(FilesystemPreRequirements(thickPluginRunDir)).To(Succeed())
+			Expect(writeParallelDaemonConfig(thickPluginRunDir, delegateDelay)).To(Succeed())
+			cniServer, err = startCNIServerWithExec(thickPluginRunDir, K8sClient, &fakeExec{delay: delegateDelay})
+			Expect(err).NotTo(HaveOccurred())
+
+			netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(prepareCNIEnv(netns.Path(), "test", podName, "testUID")).To(Succeed())
+			Expect(createFakePod(K8sClient, podName)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(cniServer.Close()).To(Succeed())
+			Expect(teardownCNIEnv()).To(Succeed())
+			Expect(K8sClient.Client.CoreV1().Pods("test").Delete(
+				context.TODO(), podName, metav1.DeleteOptions{}))
+		})
+
+		It("fans delegates out concurrently, well under their combined delay", func() {
+			start := time.Now()
+			Expect(CmdAdd(cniCmdArgs(
+				containerID, netns.Path(), ifaceName,
+				referenceConfigNDelegates(thickPluginRunDir, delegateCount)))).To(Succeed())
+			elapsed := time.Since(start)
+
+			Expect(elapsed).To(BeNumerically("<", delegateDelay*perDelegateGrace))
+		})
+
+		It("merges parallel results back in declared delegate order, not completion order", func() {
+			delegates := make([]*DelegateNetConf, delegateCount)
+			for i := range delegates {
+				delegate := &DelegateNetConf{}
+				raw := []byte(fmt.Sprintf(`{"name":"weave%d","cniVersion":"0.3.1","type":"weave-net"}`, i))
+				Expect(delegate.UnmarshalJSON(raw)).To(Succeed())
+				delegates[i] = delegate
+			}
+
+			manager := &libcniManager{server: &Server{
+				exec:   &indexedFakeExec{baseDelay: 20 * time.Millisecond, delegateCount: delegateCount},
+				config: daemonConfig{ParallelDelegates: true},
+			}}
+			sandbox := &PodSandbox{
+				ContainerID: containerID,
+				Netns:       netns.Path(),
+				IfName:      ifaceName,
+				Delegates:   delegates,
+			}
+
+			attachments, err := manager.Setup(context.Background(), sandbox)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attachments).To(HaveLen(delegateCount))
+
+			for i, attachment := range attachments {
+				Expect(attachment.Delegate.Name).To(Equal(fmt.Sprintf("weave%d", i)))
+				result, ok := attachment.Result.(*rawResult)
+				Expect(ok).To(BeTrue())
+				Expect(string(result.data)).To(Equal(fmt.Sprintf(`{"name":"weave%d"}`, i)),
+					"delegate %d's result must be its own, not whichever delegate finished first", i)
+			}
+		})
+	})
+
+	Context("reconciling orphaned attachments on restart", func() {
+		const (
+			containerID = "555555555"
+			ifaceName   = "eth0"
+			podName     = "my-reconciled-pod"
+		)
+
+		var (
+			K8sClient *k8s.ClientInfo
+			netns     ns.NetNS
+			exec      *fakeExec
+		)
+
+		BeforeEach(func() {
+			var err error
+			K8sClient = fakeK8sClient()
+
+			Expect(FilesystemPreRequirements(thickPluginRunDir)).To(Succeed())
+
+			netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(prepareCNIEnv(netns.Path(), "test", podName, "testUID")).To(Succeed())
+			Expect(createFakePod(K8sClient, podName)).To(Succeed())
+
+			exec = &fakeExec{}
+		})
+
+		AfterEach(func() {
+			Expect(teardownCNIEnv()).To(Succeed())
+		})
+
+		It("GCs an attachment whose pod was deleted behind the daemon's back", func() {
+			cniServer, err := startCNIServerWithExec(thickPluginRunDir, K8sClient, exec)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(CmdAdd(cniCmdArgs(containerID, netns.Path(), ifaceName, referenceConfig(thickPluginRunDir)))).To(Succeed())
+			Expect(attachmentRecordExists(thickPluginRunDir, containerID)).To(BeTrue())
+
+			// The pod disappears without multus ever hearing a DEL for it.
+			Expect(K8sClient.Client.CoreV1().Pods("test").Delete(
+				context.TODO(), podName, metav1.DeleteOptions{})).To(Succeed())
+
+			// Restart the daemon against the same run dir: it should pick
+			// up the persisted record from disk.
+			Expect(cniServer.Close()).To(Succeed())
+			restarted, err := startCNIServerWithExec(thickPluginRunDir, K8sClient, exec)
+			Expect(err).NotTo(HaveOccurred())
+			defer restarted.Close()
+
+			restarted.Reconcile(context.Background())
+
+			Expect(exec.seenCommands()).To(ContainElement("DEL"))
+			Expect(attachmentRecordExists(thickPluginRunDir, containerID)).To(BeFalse())
 		})
 	})
 })
@@ -204,10 +534,10 @@ func createFakePod(k8sClient *k8s.ClientInfo, podName string) error {
 	return err
 }
 
-func startCNIServer(runDir string, k8sClient *k8s.ClientInfo) (*Server, error) {
+func startCNIServerWithExec(runDir string, k8sClient *k8s.ClientInfo, exec invoke.Exec) (*Server, error) {
 	const period = 0
 
-	cniServer, err := newCNIServer(runDir, k8sClient, &fakeExec{})
+	cniServer, err := newCNIServer(runDir, k8sClient, exec)
 	if err != nil {
 		return nil, err
 	}
@@ -240,3 +570,73 @@ func referenceConfig(thickPluginSocketDir string) string {
         }]}`
 	return fmt.Sprintf(referenceConfigTemplate, thickPluginSocketDir)
 }
+
+// referenceConfigNDelegates is referenceConfig's many-delegate sibling, used
+// to exercise parallel delegate invocation.
+func referenceConfigNDelegates(thickPluginSocketDir string, delegateCount int) string {
+	const delegateTemplate = `{"name": "weave%d", "cniVersion": "0.3.1", "type": "weave-net"}`
+
+	delegates := make([]string, delegateCount)
+	for i := 0; i < delegateCount; i++ {
+		delegates[i] = fmt.Sprintf(delegateTemplate, i)
+	}
+
+	const referenceConfigTemplate = `{
+        "name": "node-cni-network",
+        "type": "multus",
+        "socketDir": "%s",
+        "defaultnetworkfile": "/tmp/foo.multus.conf",
+        "defaultnetworkwaitseconds": 3,
+        "parallelDelegates": true,
+        "delegates": [%s]}`
+	return fmt.Sprintf(referenceConfigTemplate, thickPluginSocketDir, strings.Join(delegates, ","))
+}
+
+// attachmentRecordExists reports whether the persisted attachment record
+// for containerID is still present on disk.
+func attachmentRecordExists(rundir, containerID string) bool {
+	raw, err := ioutil.ReadFile(attachmentRecordPath(rundir))
+	if err != nil {
+		return false
+	}
+
+	var records []*attachmentRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return false
+	}
+	for _, record := range records {
+		if record.ContainerID == containerID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeParallelDaemonConfig drops a daemon-config.json enabling
+// parallelDelegates, with a per-delegate timeout comfortably above delay, so
+// the reconciliation/timeout machinery doesn't itself become the bottleneck
+// being measured.
+func writeParallelDaemonConfig(rundir string, delay time.Duration) error {
+	const timeoutGraceSeconds = 10
+
+	config := daemonConfig{
+		ParallelDelegates:         true,
+		PerDelegateTimeoutSeconds: int(delay.Seconds()) + timeoutGraceSeconds,
+	}
+
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(rundir, "daemon-config.json"), raw, 0600)
+}
+
+// writeManagerDaemonConfig drops a daemon-config.json selecting the named
+// NetworkManager.
+func writeManagerDaemonConfig(rundir, manager string) error {
+	raw, err := json.Marshal(daemonConfig{NetworkManager: manager})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(rundir, "daemon-config.json"), raw, 0600)
+}
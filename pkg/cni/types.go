@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	multustypes "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+)
+
+// NetConf is the multus network configuration the CNI runtime passes to the
+// shim on stdin. It names the delegates the thick daemon should invoke for a
+// given pod.
+type NetConf struct {
+	cnitypes.NetConf
+
+	// SocketDir is the directory the thick daemon's unix socket lives in.
+	SocketDir string `json:"socketDir"`
+
+	// DefaultNetworkFile points at the cluster default network's CNI config.
+	DefaultNetworkFile string `json:"defaultnetworkfile,omitempty"`
+
+	// DefaultNetworkWaitSeconds bounds how long multus waits for the default
+	// network's config file to appear.
+	DefaultNetworkWaitSeconds int `json:"defaultnetworkwaitseconds,omitempty"`
+
+	// ParallelDelegates is accepted on the wire but not consulted: whether a
+	// pod's delegates run concurrently is decided by the daemon's own
+	// daemonConfig.ParallelDelegates.
+	ParallelDelegates bool `json:"parallelDelegates,omitempty"`
+
+	// PodPortMappings are port mappings that apply to the pod as a whole,
+	// as materialized on the wire. handleCNIRequest merges these with
+	// mappings derived from the pod's own containerPort declarations (see
+	// podPortMappings) and with each delegate's own PortMappings before
+	// handing the result to a delegate that advertises the "portMappings"
+	// capability.
+	PodPortMappings []*multustypes.PortMapping `json:"podPortMappings,omitempty"`
+
+	// Delegates are the CNI plugins multus fans this request out to.
+	Delegates []*DelegateNetConf `json:"delegates"`
+}
+
+// DelegateNetConf is a single CNI plugin invocation multus performs on
+// behalf of a pod's network attachment.
+type DelegateNetConf struct {
+	Name string           `json:"name"`
+	Conf cnitypes.NetConf `json:"-"`
+
+	// PortMappings are this attachment's own port mappings, parsed straight
+	// out of the delegate's raw "portMappings" config field in
+	// UnmarshalJSON below (whatever produced this delegate's JSON - not
+	// multus itself in this chunk - is responsible for having put them
+	// there).
+	PortMappings []*multustypes.PortMapping `json:"-"`
+
+	raw map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON keeps DelegateNetConf's raw plugin config around (in Conf)
+// while still exposing the fields multus itself cares about, since a
+// delegate's config is an arbitrary third-party CNI plugin config.
+func (d *DelegateNetConf) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Conf); err != nil {
+		return fmt.Errorf("failed to parse delegate conf: %v", err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse delegate conf: %v", err)
+	}
+	d.raw = raw
+
+	if name, ok := raw["name"].(string); ok {
+		d.Name = name
+	}
+
+	if rawPortMappings, ok := raw["portMappings"]; ok {
+		encoded, err := json.Marshal(rawPortMappings)
+		if err != nil {
+			return fmt.Errorf("failed to parse delegate %s port mappings: %v", d.Name, err)
+		}
+		if err := json.Unmarshal(encoded, &d.PortMappings); err != nil {
+			return fmt.Errorf("failed to parse delegate %s port mappings: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON round-trips the delegate's original configuration.
+func (d *DelegateNetConf) MarshalJSON() ([]byte, error) {
+	if d.raw != nil {
+		return json.Marshal(d.raw)
+	}
+	return json.Marshal(d.Conf)
+}
+
+// loadNetConf parses the multus NetConf the CNI runtime hands the shim.
+func loadNetConf(data []byte) (*NetConf, error) {
+	netConf := &NetConf{}
+	if err := json.Unmarshal(data, netConf); err != nil {
+		return nil, fmt.Errorf("failed to parse multus netconf: %v", err)
+	}
+	if netConf.SocketDir == "" {
+		return nil, fmt.Errorf("multus netconf is missing socketDir")
+	}
+	return netConf, nil
+}
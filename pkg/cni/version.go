@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// protocolVersionHeader carries the negotiated wire-protocol version on
+// every shim->daemon request once the shim has talked to /version. Unknown
+// headers and unknown JSON fields are ignored by both sides, so an old shim
+// talking to a new daemon (or vice versa) never fails a request just
+// because it doesn't recognize something.
+const protocolVersionHeader = "X-Multus-Protocol-Version"
+
+// protocolFeaturesHeader carries the shim's already-negotiated feature set
+// (a comma-separated list) alongside protocolVersionHeader, so the daemon
+// doesn't have to re-derive what the shim is allowed to rely on: it just
+// gates behavior on whatever the shim says it negotiated.
+const protocolFeaturesHeader = "X-Multus-Protocol-Features"
+
+const (
+	// protocolMinVersion is the oldest wire protocol this daemon build can
+	// still speak, for shims that haven't been upgraded yet.
+	protocolMinVersion = 1
+
+	// protocolMaxVersion is the newest wire protocol this daemon/shim build
+	// knows about.
+	protocolMaxVersion = 2
+)
+
+// structuredEventsFeature and cachedResultFeature are features that only
+// exist from protocol version 2 onward; a shim negotiating version 1 must
+// not rely on them.
+const (
+	structuredEventsFeature = "structuredEvents"
+	cachedResultFeature     = "cachedResult"
+)
+
+// versionInfo is what GET /version on the daemon returns, and is also the
+// shim's own understanding of itself when no daemon is reachable yet.
+type versionInfo struct {
+	MinVersion        int      `json:"minVersion"`
+	MaxVersion        int      `json:"maxVersion"`
+	SupportedFeatures []string `json:"supportedFeatures"`
+}
+
+func currentVersionInfo() versionInfo {
+	return versionInfo{
+		MinVersion:        protocolMinVersion,
+		MaxVersion:        protocolMaxVersion,
+		SupportedFeatures: []string{structuredEventsFeature, cachedResultFeature},
+	}
+}
+
+// negotiatedProtocol is the outcome of comparing a client's versionInfo
+// against a server's: the highest version both sides understand, and the
+// intersection of features available at that version.
+type negotiatedProtocol struct {
+	version  int
+	features map[string]bool
+}
+
+func (n negotiatedProtocol) hasFeature(feature string) bool {
+	return n.features[feature]
+}
+
+// headerValue renders the negotiated features as the comma-separated list
+// postToDaemon sends in protocolFeaturesHeader.
+func (n negotiatedProtocol) headerValue() string {
+	list := make([]string, 0, len(n.features))
+	for feature := range n.features {
+		list = append(list, feature)
+	}
+	return strings.Join(list, ",")
+}
+
+// parseFeatureHeader parses protocolFeaturesHeader back into a feature set.
+// An empty or missing header yields no features, matching a pre-handshake
+// shim that never sends it.
+func parseFeatureHeader(header string) map[string]bool {
+	features := map[string]bool{}
+	for _, feature := range strings.Split(header, ",") {
+		feature = strings.TrimSpace(feature)
+		if feature != "" {
+			features[feature] = true
+		}
+	}
+	return features
+}
+
+// negotiateVersion picks the highest protocol version both sides support
+// and degrades features accordingly: at version 2 or above a feature is
+// only usable if both peers advertised it, and below version 2 no feature
+// is usable, whatever either peer advertised.
+func negotiateVersion(client, server versionInfo) (negotiatedProtocol, error) {
+	version := min(client.MaxVersion, server.MaxVersion)
+	if version < max(client.MinVersion, server.MinVersion) {
+		return negotiatedProtocol{}, fmt.Errorf(
+			"no common protocol version: client supports [%d,%d], daemon supports [%d,%d]",
+			client.MinVersion, client.MaxVersion, server.MinVersion, server.MaxVersion)
+	}
+
+	serverFeatures := make(map[string]bool, len(server.SupportedFeatures))
+	for _, f := range server.SupportedFeatures {
+		serverFeatures[f] = true
+	}
+
+	features := map[string]bool{}
+	if version >= 2 {
+		for _, f := range client.SupportedFeatures {
+			if serverFeatures[f] {
+				features[f] = true
+			}
+		}
+	}
+
+	return negotiatedProtocol{version: version, features: features}, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// handleVersion serves GET /version so shims can discover this daemon's
+// supported protocol range before sending their first real CNI request.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentVersionInfo())
+}
+
+// fetchDaemonVersion calls GET /version on the daemon listening at
+// socketPath. A daemon predating the handshake (no /version route, or any
+// connection error) is treated as a legacy v1-only peer rather than a hard
+// failure, so old daemons keep working with new shims.
+func fetchDaemonVersion(socketPath string) versionInfo {
+	legacy := versionInfo{MinVersion: 1, MaxVersion: 1}
+
+	client := unixSocketClient(socketPath)
+	resp, err := client.Get("http://unix/version")
+	if err != nil {
+		return legacy
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return legacy
+	}
+
+	var info versionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return legacy
+	}
+	return info
+}
+
+func unixSocketClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+
+	k8s "gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/k8sclient"
+	"gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/server/api/legacyexamples"
+)
+
+const compatSuiteName = "Shim/daemon protocol compatibility"
+
+var _ = Describe(compatSuiteName, func() {
+	It("negotiates down to v1 when the daemon predates the handshake", func() {
+		legacyDaemon := versionInfo{MinVersion: 1, MaxVersion: 1}
+		currentShim := currentVersionInfo()
+
+		negotiated, err := negotiateVersion(currentShim, legacyDaemon)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(negotiated.version).To(Equal(1))
+		Expect(negotiated.hasFeature(structuredEventsFeature)).To(BeFalse())
+	})
+
+	It("negotiates up to the newest shared version and intersects features", func() {
+		currentDaemon := currentVersionInfo()
+		currentShim := currentVersionInfo()
+
+		negotiated, err := negotiateVersion(currentShim, currentDaemon)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(negotiated.version).To(Equal(protocolMaxVersion))
+		Expect(negotiated.hasFeature(structuredEventsFeature)).To(BeTrue())
+		Expect(negotiated.hasFeature(cachedResultFeature)).To(BeTrue())
+	})
+
+	It("fails clearly when client and daemon share no common version", func() {
+		ancientShim := versionInfo{MinVersion: 1, MaxVersion: 1}
+		futureDaemon := versionInfo{MinVersion: 5, MaxVersion: 6}
+
+		_, err := negotiateVersion(ancientShim, futureDaemon)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("a v1 shim request still decodes on a current daemon", func() {
+		var req cniRequest
+		raw, err := json.Marshal(legacyexamples.V1RequestExample)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(json.Unmarshal(raw, &req)).To(Succeed())
+		Expect(req.Command).To(Equal(legacyexamples.V1RequestExample.Command))
+		Expect(req.ContainerID).To(Equal(legacyexamples.V1RequestExample.ContainerID))
+	})
+
+	Context("a pre-handshake shim talking to the current daemon", func() {
+		const containerID = "v1-shim-v2-daemon"
+
+		var (
+			rundir    string
+			cniServer *Server
+			netns     ns.NetNS
+		)
+
+		BeforeEach(func() {
+			var err error
+			rundir, err = ioutil.TempDir("", "multus-protocol-compat")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(FilesystemPreRequirements(rundir)).To(Succeed())
+
+			cniServer, err = startCNIServerWithExec(rundir, fakeK8sClient(), &fakeExec{})
+			Expect(err).NotTo(HaveOccurred())
+
+			netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(cniServer.Close()).To(Succeed())
+			Expect(os.RemoveAll(rundir)).To(Succeed())
+		})
+
+		It("still completes ADD, CHECK and DEL with no version or features header at all", func() {
+			config := []byte(referenceConfig(rundir))
+
+			for _, command := range []string{"ADD", "CHECK", "DEL"} {
+				status, err := sendRawCNIRequest(rundir, command, containerID, netns.Path(), "eth0", config, "", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status).To(Equal(http.StatusOK), "command %s", command)
+			}
+		})
+	})
+
+	Context("a current shim talking to a daemon that predates the handshake", func() {
+		const containerID = "v2-shim-v1-daemon"
+
+		var (
+			rundir    string
+			cniServer *Server
+			netns     ns.NetNS
+		)
+
+		BeforeEach(func() {
+			var err error
+			rundir, err = ioutil.TempDir("", "multus-protocol-compat")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(FilesystemPreRequirements(rundir)).To(Succeed())
+
+			cniServer, err = startLegacyCNIServer(rundir, fakeK8sClient(), &fakeExec{})
+			Expect(err).NotTo(HaveOccurred())
+
+			netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(cniServer.Close()).To(Succeed())
+			Expect(os.RemoveAll(rundir)).To(Succeed())
+		})
+
+		It("still completes ADD, CHECK and DEL through the real shim negotiation path", func() {
+			config := referenceConfig(rundir)
+
+			Expect(CmdAdd(cniCmdArgs(containerID, netns.Path(), "eth0", config))).To(Succeed())
+			Expect(CmdCheck(cniCmdArgs(containerID, netns.Path(), "eth0", config))).To(Succeed())
+			Expect(CmdDel(cniCmdArgs(containerID, netns.Path(), "eth0", config))).To(Succeed())
+		})
+	})
+
+	Context("cachedResultFeature result reuse", func() {
+		const containerID = "cached-result-container"
+
+		var (
+			rundir    string
+			cniServer *Server
+			exec      *fakeExec
+		)
+
+		BeforeEach(func() {
+			var err error
+			rundir, err = ioutil.TempDir("", "multus-protocol-compat")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(FilesystemPreRequirements(rundir)).To(Succeed())
+
+			exec = &fakeExec{}
+			cniServer, err = startCNIServerWithExec(rundir, fakeK8sClient(), exec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(cniServer.Close()).To(Succeed())
+			Expect(os.RemoveAll(rundir)).To(Succeed())
+		})
+
+		It("replays the cached response instead of re-running Setup for an identical retry", func() {
+			config := []byte(referenceConfig(rundir))
+
+			status, err := sendRawCNIRequest(rundir, "ADD", containerID, "/var/run/netns/test", "eth0", config, "2", cachedResultFeature)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(exec.seenCommands()).To(HaveLen(1))
+
+			status, err = sendRawCNIRequest(rundir, "ADD", containerID, "/var/run/netns/test", "eth0", config, "2", cachedResultFeature)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(exec.seenCommands()).To(HaveLen(1), "a cached-identical retry must not re-invoke the delegate")
+		})
+
+		It("re-runs Setup when the retried ADD targets a different netns", func() {
+			config := []byte(referenceConfig(rundir))
+
+			status, err := sendRawCNIRequest(rundir, "ADD", containerID, "/var/run/netns/test-a", "eth0", config, "2", cachedResultFeature)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(exec.seenCommands()).To(HaveLen(1))
+
+			// Same containerID, same config, but a recreated sandbox (new
+			// netns) - a real CRI retry pattern. The stale cached response
+			// must never be replayed for it.
+			status, err = sendRawCNIRequest(rundir, "ADD", containerID, "/var/run/netns/test-b", "eth0", config, "2", cachedResultFeature)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(exec.seenCommands()).To(HaveLen(2), "a recreated sandbox must not be served a stale cached response")
+		})
+	})
+})
+
+// sendRawCNIRequest posts a single CNI command straight to rundir's socket,
+// bypassing postToDaemon's own negotiation, so tests can pin exactly which
+// protocol version/features header (if any) a request carries.
+func sendRawCNIRequest(rundir, command, containerID, netnsPath, ifName string, config []byte, version, features string) (int, error) {
+	body, err := json.Marshal(cniRequest{
+		Command:     command,
+		ContainerID: containerID,
+		Netns:       netnsPath,
+		IfName:      ifName,
+		Config:      config,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://unix/cni", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if version != "" {
+		req.Header.Set(protocolVersionHeader, version)
+	}
+	if features != "" {
+		req.Header.Set(protocolFeaturesHeader, features)
+	}
+
+	resp, err := unixSocketClient(SocketPath(rundir)).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// startLegacyCNIServer starts a real Server the same way startCNIServerWithExec
+// does, except its mux only ever serves /cni, the way a daemon binary that
+// predates the /version handshake actually looked on the wire:
+// fetchDaemonVersion sees a 404 on /version and falls back to treating it as
+// a v1-only peer.
+func startLegacyCNIServer(rundir string, k8sClient *k8s.ClientInfo, exec invoke.Exec) (*Server, error) {
+	cniServer, err := newCNIServer(rundir, k8sClient, exec)
+	if err != nil {
+		return nil, err
+	}
+
+	legacyMux := http.NewServeMux()
+	legacyMux.HandleFunc("/cni", cniServer.handleCNIRequest)
+	cniServer.Handler = legacyMux
+
+	l, err := ServerListener(SocketPath(rundir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start legacy CNI server using socket %s: %v", SocketPath(rundir), err)
+	}
+
+	cniServer.SetKeepAlivesEnabled(false)
+	go utilwait.Forever(func() {
+		if err := cniServer.Serve(l); err != nil {
+			utilruntime.HandleError(fmt.Errorf("legacy CNI server Serve() failed: %v", err))
+		}
+	}, 0)
+	return cniServer, nil
+}
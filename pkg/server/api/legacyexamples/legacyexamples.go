@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package legacyexamples pins the shim<->daemon wire formats from previous
+// multus thick-daemon protocol versions. Nothing in the live code path
+// imports these types; they exist purely as fixed fixtures.
+// version_compat_test.go decodes V1RequestExample into the current
+// cniRequest struct and checks its command and containerID fields, so a
+// rename or removal of either of those in cni.go shows up as a test failure
+// here instead of in the field. CNIResponseV1 is pinned but not decoded by
+// any test.
+package legacyexamples
+
+// CNIRequestV1 is the shim->daemon request body before the protocol version
+// handshake was introduced. It has no notion of a negotiated version, and
+// carries no structured-events or cached-result fields.
+type CNIRequestV1 struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName"`
+	Config      []byte `json:"config"`
+}
+
+// CNIResponseV1 is the daemon->shim response body before the protocol
+// version handshake was introduced.
+type CNIResponseV1 struct {
+	Results []interface{} `json:"results,omitempty"`
+}
+
+// V1RequestExample is a fixed, never-to-be-edited example of a v1 request
+// as it was actually observed on the wire, used by version_compat_test.go
+// to prove a v1 shim's request still decodes cleanly on a newer daemon.
+var V1RequestExample = CNIRequestV1{
+	Command:     "ADD",
+	ContainerID: "123456789",
+	Netns:       "/var/run/netns/test",
+	IfName:      "eth0",
+	Config:      []byte(`{"name":"node-cni-network","type":"multus","socketDir":"/var/run/multus","delegates":[{"name":"weave1","cniVersion":"0.3.1","type":"weave-net"}]}`),
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Multus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package types holds the multus-specific types shared across the shim and
+// the thick daemon.
+package types
+
+// PortMapping is a single host<->container port mapping multus forwards to
+// a delegate that advertises the "portMappings" CNI capability, either as a
+// per-attachment mapping parsed off a delegate's own config or as part of a
+// pod's PodPortMappings; see pkg/cni/portmapping.go for how the two get
+// merged before being handed to a delegate.
+type PortMapping struct {
+	// HostPort is the port opened on the host (or the start of a range,
+	// when HostPortEnd is set).
+	HostPort int `json:"hostPort"`
+
+	// ContainerPort is the port inside the pod's network namespace that
+	// HostPort forwards to.
+	ContainerPort int `json:"containerPort"`
+
+	// Protocol is the transport protocol, e.g. "tcp" or "udp". Its case is
+	// kept as given (mappings derived from a pod's containerPorts carry
+	// Kubernetes' upper-case "TCP"/"UDP") and ignored when mappings are
+	// compared. Defaults to "tcp" when empty.
+	Protocol string `json:"protocol,omitempty"`
+
+	// HostIP restricts the mapping to a single host address. Empty means
+	// all host addresses.
+	HostIP string `json:"hostIP,omitempty"`
+
+	// HostPortEnd, when non-zero, turns HostPort into the start of an
+	// inclusive [HostPort, HostPortEnd] range.
+	HostPortEnd int `json:"hostPortEnd,omitempty"`
+}